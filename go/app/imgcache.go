@@ -0,0 +1,81 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// MaxCachedImgSize is the largest image kept in the cache.
+// Bigger files are always read from disk.
+const MaxCachedImgSize = 1 << 20
+
+type imgEntry struct {
+	path    string
+	modTime time.Time
+	data    []byte
+}
+
+// imgCache is an LRU cache of image contents bounded by a total byte budget.
+// A zero budget disables caching.
+type imgCache struct {
+	mu      sync.Mutex
+	budget  int64
+	size    int64
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+func newImgCache(budget int64) *imgCache {
+	return &imgCache{
+		budget:  budget,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// get returns the cached contents of path, dropping the entry if the file
+// was modified since it was cached.
+func (ic *imgCache) get(path string, modTime time.Time) ([]byte, bool) {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+
+	el, ok := ic.entries[path]
+	if !ok {
+		return nil, false
+	}
+	entry := el.Value.(*imgEntry)
+	if !entry.modTime.Equal(modTime) {
+		ic.remove(el)
+		return nil, false
+	}
+	ic.lru.MoveToFront(el)
+	return entry.data, true
+}
+
+// add caches data for path, evicting the least recently used entries
+// until the cache fits in its budget.
+func (ic *imgCache) add(path string, modTime time.Time, data []byte) {
+	size := int64(len(data))
+	if size > MaxCachedImgSize || size > ic.budget {
+		return
+	}
+
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+
+	if el, ok := ic.entries[path]; ok {
+		ic.remove(el)
+	}
+	ic.entries[path] = ic.lru.PushFront(&imgEntry{path: path, modTime: modTime, data: data})
+	ic.size += size
+	for ic.size > ic.budget {
+		ic.remove(ic.lru.Back())
+	}
+}
+
+func (ic *imgCache) remove(el *list.Element) {
+	entry := ic.lru.Remove(el).(*imgEntry)
+	delete(ic.entries, entry.path)
+	ic.size -= int64(len(entry.data))
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestImgCacheEviction(t *testing.T) {
+	ic := newImgCache(3)
+	now := time.Now()
+	ic.add("a", now, []byte("a"))
+	ic.add("b", now, []byte("b"))
+	ic.add("c", now, []byte("c"))
+
+	// Touching a makes b the least recently used entry
+	if _, ok := ic.get("a", now); !ok {
+		t.Fatal("a missing before eviction")
+	}
+	ic.add("d", now, []byte("d"))
+
+	if _, ok := ic.get("b", now); ok {
+		t.Error("b cached, want it evicted as least recently used")
+	}
+	for _, path := range []string{"a", "c", "d"} {
+		if _, ok := ic.get(path, now); !ok {
+			t.Errorf("%s missing, want it cached", path)
+		}
+	}
+	if ic.size != 3 {
+		t.Errorf("size = %d, want 3", ic.size)
+	}
+}
+
+func TestImgCacheBudget(t *testing.T) {
+	ic := newImgCache(4)
+	now := time.Now()
+	ic.add("small", now, []byte("ab"))
+	ic.add("big", now, []byte("abcde"))
+
+	if _, ok := ic.get("big", now); ok {
+		t.Error("entry larger than the budget was cached")
+	}
+	if _, ok := ic.get("small", now); !ok {
+		t.Error("small entry evicted by an entry that was never cached")
+	}
+
+	ic.add("small", now, []byte("abcd"))
+	if ic.size != 4 || ic.lru.Len() != 1 {
+		t.Errorf("size = %d with %d entries, want a replaced entry counted once", ic.size, ic.lru.Len())
+	}
+}
+
+func TestImgCacheModTime(t *testing.T) {
+	ic := newImgCache(10)
+	now := time.Now()
+	ic.add("a", now, []byte("old"))
+
+	if _, ok := ic.get("a", now.Add(time.Second)); ok {
+		t.Error("stale entry returned after the file changed")
+	}
+	if ic.size != 0 || len(ic.entries) != 0 {
+		t.Errorf("size = %d with %d entries, want the stale entry dropped", ic.size, len(ic.entries))
+	}
+}
+
+func TestImgCacheDisabled(t *testing.T) {
+	ic := newImgCache(0)
+	ic.add("a", time.Now(), []byte("a"))
+	if ic.lru.Len() != 0 {
+		t.Error("zero budget cache stored an entry")
+	}
+}
+
+func TestServeImgCacheDisabled(t *testing.T) {
+	cfg := testConfig()
+	cfg.ImgDir = t.TempDir()
+	cfg.ImgCacheBytes = 0
+	if err := os.WriteFile(path.Join(cfg.ImgDir, "a.jpg"), []byte("jpeg"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	newServer(cfg, nil).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/image/a.jpg", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "jpeg" {
+		t.Errorf("got %d %q, want 200 with the file contents", rec.Code, rec.Body.String())
+	}
+}
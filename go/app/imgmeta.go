@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+const (
+	// MaxImgMetadataBatch caps the number of files per POST /images/metadata.
+	MaxImgMetadataBatch = 100
+	// MaxImgMetadataBodyBytes bounds the request body, leaving room for
+	// MaxImgMetadataBatch filenames of up to 512 bytes each.
+	MaxImgMetadataBodyBytes = MaxImgMetadataBatch * 512
+)
+
+type ImgMetadataRequest struct {
+	Filenames []string `json:"filenames"`
+}
+
+type ImgMetadata struct {
+	Filename    string `json:"filename"`
+	Exists      bool   `json:"exists"`
+	ServedAs    string `json:"served_as,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	Size        int64  `json:"size"`
+}
+
+type ImgMetadataList struct {
+	Images []ImgMetadata `json:"images"`
+}
+
+// statImg reports whether GET /image/<filename> would find an image, using
+// the same extension fallback as getImg, along with the file actually served,
+// its size and a content type sniffed from the first bytes.
+func statImg(imgDir, filename string) ImgMetadata {
+	meta := ImgMetadata{Filename: filename}
+	// Only plain file names are looked up, never paths
+	if path.Base(filename) != filename || !isImgExt(path.Ext(filename)) {
+		return meta
+	}
+	imgPath, ok := findImg(imgDir, filename)
+	if !ok {
+		return meta
+	}
+	f, err := os.Open(imgPath)
+	if err != nil {
+		return meta
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		return meta
+	}
+
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return meta
+	}
+	meta.Exists = true
+	meta.ServedAs = path.Base(imgPath)
+	meta.Size = info.Size()
+	meta.ContentType = http.DetectContentType(head[:n])
+	return meta
+}
+
+// imgMetadataLimit bounds the request body of POST /images/metadata so a
+// huge filename list is rejected before it is decoded.
+func imgMetadataLimit() echo.MiddlewareFunc {
+	return middleware.BodyLimit(strconv.Itoa(MaxImgMetadataBodyBytes))
+}
+
+func getImgMetadata(imgDir string) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var req ImgMetadataRequest
+		if err := c.Bind(&req); err != nil {
+			return err
+		}
+		if len(req.Filenames) == 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "No filenames given")
+		}
+		if len(req.Filenames) > MaxImgMetadataBatch {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("At most %d filenames are allowed", MaxImgMetadataBatch))
+		}
+
+		res := ImgMetadataList{Images: make([]ImgMetadata, 0, len(req.Filenames))}
+		for _, filename := range req.Filenames {
+			res.Images = append(res.Images, statImg(imgDir, filename))
+		}
+		return c.JSON(http.StatusOK, res)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestStatImgExtensionFallback(t *testing.T) {
+	imgDir := t.TempDir()
+	png := []byte("\x89PNG\r\n\x1a\n")
+	if err := os.WriteFile(path.Join(imgDir, "abc.png"), png, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	meta := statImg(imgDir, "abc.jpg")
+	if !meta.Exists || meta.ServedAs != "abc.png" || meta.ContentType != "image/png" {
+		t.Errorf("statImg(abc.jpg) = %+v, want abc.png served as image/png", meta)
+	}
+	if meta := statImg(imgDir, "missing.jpg"); meta.Exists {
+		t.Errorf("statImg(missing.jpg) = %+v, want missing", meta)
+	}
+}
+
+// postMetadata sends a JSON body to POST /images/metadata.
+func postMetadata(t *testing.T, cfg Config, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/images/metadata", strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	newServer(cfg, nil).ServeHTTP(rec, req)
+	return rec
+}
+
+func TestGetImgMetadata(t *testing.T) {
+	cfg := testConfig()
+	cfg.ImgDir = t.TempDir()
+	if err := os.WriteFile(path.Join(cfg.ImgDir, "x.jpg"), encodeImg(t, "jpeg", 1, 1), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := postMetadata(t, cfg, `{"filenames":["x.jpg","../x.jpg","a/b.jpg"]}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusOK, rec.Body.String())
+	}
+	var res ImgMetadataList
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Images) != 3 {
+		t.Fatalf("images = %+v, want 3 entries", res.Images)
+	}
+	if !res.Images[0].Exists {
+		t.Errorf("x.jpg = %+v, want it to exist", res.Images[0])
+	}
+	for _, meta := range res.Images[1:] {
+		if meta.Exists {
+			t.Errorf("%s = %+v, want path-like names to never exist", meta.Filename, meta)
+		}
+	}
+}
+
+func TestGetImgMetadataRejected(t *testing.T) {
+	tooMany, err := json.Marshal(ImgMetadataRequest{Filenames: make([]string, MaxImgMetadataBatch+1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name     string
+		body     string
+		wantCode int
+		wantBody string
+	}{
+		{"empty list", `{"filenames":[]}`, http.StatusBadRequest, `{"message":"No filenames given"}`},
+		{"too many filenames", string(tooMany), http.StatusBadRequest, `{"message":"At most 100 filenames are allowed"}`},
+		{"body too large", `{"filenames":["` + strings.Repeat("a", MaxImgMetadataBodyBytes) + `"]}`, http.StatusRequestEntityTooLarge, `{"message":"Request Entity Too Large"}`},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := postMetadata(t, testConfig(), tc.body)
+			if rec.Code != tc.wantCode {
+				t.Errorf("status = %d, want %d", rec.Code, tc.wantCode)
+			}
+			if got := strings.TrimSpace(rec.Body.String()); got != tc.wantBody {
+				t.Errorf("body = %s, want %s", got, tc.wantBody)
+			}
+		})
+	}
+}
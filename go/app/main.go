@@ -1,19 +1,39 @@
 package main
 
 import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"os"
 	"path"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 	"github.com/labstack/gommon/log"
+	"golang.org/x/text/unicode/norm"
 )
 
 const (
-	ImgDir = "images"
+	DefaultAddr     = ":9000"
+	DefaultImgDir   = "images"
+	DefaultImg      = "default.jpg"
+	DefaultLogLevel = "INFO"
+
+	DefaultLogSkipPaths = "/healthz,/image/*"
+
+	DefaultImgCacheBytes  = 32 << 20
+	DefaultMaxUploadBytes = 5 << 20
+	DefaultImgMinDim      = 1
+	DefaultImgMaxDim      = 8192
+
+	DefaultReadTimeout   = 5 * time.Second
+	DefaultUploadTimeout = 60 * time.Second
 )
 
 type Response struct {
@@ -25,55 +45,555 @@ func root(c echo.Context) error {
 	return c.JSON(http.StatusOK, res)
 }
 
+// ItemForm is the form data accepted by addItem.
+// Bind accepts form and JSON bodies; a body without Content-Type is 415.
+// Image files are read separately since Bind doesn't handle them.
+type ItemForm struct {
+	Name string `form:"name" json:"name"`
+}
+
 func addItem(c echo.Context) error {
 	// Get form data
-	name := c.FormValue("name")
-	c.Logger().Infof("Receive item: %s", name)
+	var form ItemForm
+	if err := c.Bind(&form); err != nil {
+		// Bind returns a 400 HTTPError describing the failure
+		return err
+	}
+	// Store names in NFC so composed and decomposed forms compare equal
+	form.Name = norm.NFC.String(form.Name)
+	c.Logger().Infof("Receive item: %s", form.Name)
 
-	message := fmt.Sprintf("item received: %s", name)
+	message := fmt.Sprintf("item received: %s", form.Name)
 	res := Response{Message: message}
 
 	return c.JSON(http.StatusOK, res)
 }
 
-func getImg(c echo.Context) error {
-	// Create image path
-	imgPath := path.Join(ImgDir, c.Param("imageFilename"))
+// ImgExts are the image formats served by getImg, in fallback order.
+var ImgExts = []string{".jpg", ".jpeg", ".png"}
+
+func isImgExt(ext string) bool {
+	for _, e := range ImgExts {
+		if e == ext {
+			return true
+		}
+	}
+	return false
+}
 
-	if !strings.HasSuffix(imgPath, ".jpg") {
-		res := Response{Message: "Image path does not end with .jpg"}
-		return c.JSON(http.StatusBadRequest, res)
+// findImg returns the path of the requested image in imgDir, trying the
+// other known extensions for the same name when the exact file is missing.
+func findImg(imgDir, filename string) (string, bool) {
+	imgPath := path.Join(imgDir, filename)
+	if _, err := os.Stat(imgPath); err == nil {
+		return imgPath, true
 	}
-	if _, err := os.Stat(imgPath); err != nil {
-		c.Logger().Debugf("Image not found: %s", imgPath)
-		imgPath = path.Join(ImgDir, "default.jpg")
+	base := strings.TrimSuffix(imgPath, path.Ext(imgPath))
+	for _, ext := range ImgExts {
+		if _, err := os.Stat(base + ext); err == nil {
+			return base + ext, true
+		}
 	}
-	return c.File(imgPath)
+	return "", false
 }
 
-func main() {
-	e := echo.New()
+// getImg serves images from imgDir. Unsupported extensions are always 404;
+// missing files are served as DefaultImg when fallback is set, 404 otherwise.
+func getImg(imgDir string, cache *imgCache, fallback bool) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		filename := c.Param("imageFilename")
 
-	// Middleware
-	e.Use(middleware.Logger())
-	e.Use(middleware.Recover())
-	e.Logger.SetLevel(log.INFO)
+		if !isImgExt(path.Ext(filename)) {
+			c.Logger().Debugf("Unsupported image extension: %s", filename)
+			return echo.NewHTTPError(http.StatusNotFound, "Image not found")
+		}
+		imgPath, ok := findImg(imgDir, filename)
+		if !ok {
+			c.Logger().Debugf("Image not found: %s", filename)
+			if !fallback {
+				return echo.NewHTTPError(http.StatusNotFound, "Image not found")
+			}
+			imgPath = path.Join(imgDir, DefaultImg)
+		}
+		return serveImg(c, cache, imgPath)
+	}
+}
+
+// serveImg writes the image at imgPath, going through the cache for small
+// files unless caching is disabled. Content-Type follows the extension of
+// the file actually served.
+func serveImg(c echo.Context, cache *imgCache, imgPath string) error {
+	if cache.budget == 0 {
+		return c.File(imgPath)
+	}
+	info, err := os.Stat(imgPath)
+	if err != nil || info.Size() > MaxCachedImgSize {
+		return c.File(imgPath)
+	}
+	data, ok := cache.get(imgPath, info.ModTime())
+	if !ok {
+		if data, err = os.ReadFile(imgPath); err != nil {
+			return c.File(imgPath)
+		}
+		cache.add(imgPath, info.ModTime(), data)
+	}
+	http.ServeContent(c.Response(), c.Request(), info.Name(), info.ModTime(), bytes.NewReader(data))
+	return nil
+}
+
+type Check struct {
+	Name  string `json:"name"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+type Health struct {
+	Status string  `json:"status"`
+	Checks []Check `json:"checks"`
+}
+
+// probe runs the checks that only read from disk, so they are cheap and
+// safe enough to repeat on every /healthz request.
+func probe(imgDir string) []Check {
+	checks := []Check{
+		{Name: "img_dir"},
+		{Name: "default_image"},
+	}
+
+	if info, err := os.Stat(imgDir); err != nil {
+		checks[0].Error = err.Error()
+	} else if !info.IsDir() {
+		checks[0].Error = fmt.Sprintf("%s is not a directory", imgDir)
+	} else {
+		checks[0].OK = true
+	}
+
+	if _, err := os.Stat(path.Join(imgDir, DefaultImg)); err != nil {
+		checks[1].Error = err.Error()
+	} else {
+		checks[1].OK = true
+	}
+
+	return checks
+}
 
+// selfCheck verifies the environment the server depends on at startup.
+// On top of probe it writes a temp file into imgDir, so it only runs once.
+func selfCheck(imgDir string) []Check {
+	check := Check{Name: "img_dir_writable"}
+	if f, err := os.CreateTemp(imgDir, ".selfcheck-*"); err != nil {
+		check.Error = err.Error()
+	} else {
+		f.Close()
+		os.Remove(f.Name())
+		check.OK = true
+	}
+	return append([]Check{check}, probe(imgDir)...)
+}
+
+// healthz reports the startup self-check results with the probe checks
+// re-run on every request, so a missing image dir or default image turns
+// the server unhealthy without restarting it.
+func healthz(imgDir string, checks []Check) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		fresh := probe(imgDir)
+		rerun := make(map[string]bool, len(fresh))
+		for _, check := range fresh {
+			rerun[check.Name] = true
+		}
+
+		res := Health{Status: "ok"}
+		for _, check := range checks {
+			if !rerun[check.Name] {
+				res.Checks = append(res.Checks, check)
+			}
+		}
+		res.Checks = append(res.Checks, fresh...)
+
+		code := http.StatusOK
+		for _, check := range res.Checks {
+			if !check.OK {
+				res.Status = "unhealthy"
+				code = http.StatusServiceUnavailable
+			}
+		}
+		return c.JSON(code, res)
+	}
+}
+
+// Config is the effective server configuration read from the environment.
+// It must never hold secrets since it is exposed by GET /admin/config.
+type Config struct {
+	Addr              string        `json:"addr"`
+	ImgDir            string        `json:"img_dir"`
+	LogLevel          string        `json:"log_level"`
+	LogSkipPaths      string        `json:"log_skip_paths"`
+	CORSOrigins       []string      `json:"cors_origins"`
+	ReadTimeout       time.Duration `json:"-"`
+	UploadTimeout     time.Duration `json:"-"`
+	StrictQueryParams bool          `json:"strict_query_params"`
+	ImgCacheBytes     int64         `json:"img_cache_bytes"`
+	ImgFallback       bool          `json:"img_fallback"`
+	MaxUploadBytes    int64         `json:"max_upload_bytes"`
+	ImgMinDim         int           `json:"img_min_dim"`
+	ImgMaxDim         int           `json:"img_max_dim"`
+}
+
+// MarshalJSON renders durations as strings such as "5s".
+func (cfg Config) MarshalJSON() ([]byte, error) {
+	type config Config
+	return json.Marshal(struct {
+		config
+		ReadTimeout   string `json:"read_timeout"`
+		UploadTimeout string `json:"upload_timeout"`
+	}{config(cfg), cfg.ReadTimeout.String(), cfg.UploadTimeout.String()})
+}
+
+func loadConfig() Config {
 	front_url := os.Getenv("FRONT_URL")
 	if front_url == "" {
 		front_url = "http://localhost:3000"
 	}
+	addr := os.Getenv("ADDR")
+	if addr == "" {
+		addr = DefaultAddr
+	}
+	imgDir := os.Getenv("IMG_DIR")
+	if imgDir == "" {
+		imgDir = DefaultImgDir
+	}
+	logLevel := os.Getenv("LOG_LEVEL")
+	if logLevel == "" {
+		logLevel = DefaultLogLevel
+	}
+	logSkipPaths, ok := os.LookupEnv("LOG_SKIP_PATHS")
+	if !ok {
+		logSkipPaths = DefaultLogSkipPaths
+	}
+	return Config{
+		Addr:              addr,
+		ImgDir:            imgDir,
+		LogLevel:          strings.ToUpper(logLevel),
+		LogSkipPaths:      logSkipPaths,
+		CORSOrigins:       []string{front_url},
+		ReadTimeout:       getEnvDuration("READ_TIMEOUT", DefaultReadTimeout),
+		UploadTimeout:     getEnvDuration("UPLOAD_TIMEOUT", DefaultUploadTimeout),
+		StrictQueryParams: os.Getenv("STRICT_QUERY_PARAMS") == "true",
+		ImgCacheBytes:     getEnvInt("IMG_CACHE_BYTES", DefaultImgCacheBytes),
+		ImgFallback:       os.Getenv("IMG_FALLBACK") != "false",
+		MaxUploadBytes:    getEnvInt("MAX_UPLOAD_BYTES", DefaultMaxUploadBytes),
+		ImgMinDim:         int(getEnvInt("IMG_MIN_DIM", DefaultImgMinDim)),
+		ImgMaxDim:         int(getEnvInt("IMG_MAX_DIM", DefaultImgMaxDim)),
+	}
+}
+
+// LogLevels are the accepted LOG_LEVEL values.
+var LogLevels = map[string]log.Lvl{
+	"DEBUG": log.DEBUG,
+	"INFO":  log.INFO,
+	"WARN":  log.WARN,
+	"ERROR": log.ERROR,
+	"OFF":   log.OFF,
+}
+
+// Validate rejects settings that would make the handlers unusable.
+func (cfg Config) Validate() error {
+	if _, ok := LogLevels[cfg.LogLevel]; !ok {
+		return fmt.Errorf("LOG_LEVEL must be one of DEBUG, INFO, WARN, ERROR or OFF, got %q", cfg.LogLevel)
+	}
+	if cfg.MaxUploadBytes <= 0 {
+		return fmt.Errorf("MAX_UPLOAD_BYTES must be positive, got %d", cfg.MaxUploadBytes)
+	}
+	if cfg.ImgMaxDim <= 0 {
+		return fmt.Errorf("IMG_MAX_DIM must be positive, got %d", cfg.ImgMaxDim)
+	}
+	if cfg.ImgMinDim > cfg.ImgMaxDim {
+		return fmt.Errorf("IMG_MIN_DIM (%d) must not exceed IMG_MAX_DIM (%d)", cfg.ImgMinDim, cfg.ImgMaxDim)
+	}
+	return nil
+}
+
+func showConfig(cfg Config) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		return c.JSON(http.StatusOK, cfg)
+	}
+}
+
+// Limits are the client-facing limits enforced by the handlers.
+// Only limits that exist are listed; there are no item name/category
+// lengths, per-user item quotas or pagination caps to report yet.
+type Limits struct {
+	MaxUploadBytes      int64    `json:"max_upload_bytes"`
+	ImgContentTypes     []string `json:"img_content_types"`
+	ImgExts             []string `json:"img_exts"`
+	ImgMinDim           int      `json:"img_min_dim"`
+	ImgMaxDim           int      `json:"img_max_dim"`
+	MaxImgMetadataBatch int      `json:"max_img_metadata_batch"`
+}
+
+func getLimits(cfg Config) echo.HandlerFunc {
+	res := Limits{
+		MaxUploadBytes:      cfg.MaxUploadBytes,
+		ImgContentTypes:     ImgContentTypes,
+		ImgExts:             ImgExts,
+		ImgMinDim:           cfg.ImgMinDim,
+		ImgMaxDim:           cfg.ImgMaxDim,
+		MaxImgMetadataBatch: MaxImgMetadataBatch,
+	}
+	return func(c echo.Context) error {
+		return c.JSON(http.StatusOK, res)
+	}
+}
+
+// adminAuth only lets through requests bearing the admin token.
+func adminAuth(token string) echo.MiddlewareFunc {
+	return middleware.KeyAuth(func(key string, c echo.Context) (bool, error) {
+		return subtle.ConstantTimeCompare([]byte(key), []byte(token)) == 1, nil
+	})
+}
+
+// getEnvDuration reads a duration such as "5s" from the environment,
+// falling back to def when the variable is unset or invalid.
+func getEnvDuration(key string, def time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		log.Warnf("Invalid %s: %q, using %s", key, v, def)
+		return def
+	}
+	return d
+}
+
+// getEnvInt reads a non-negative integer from the environment,
+// falling back to def when the variable is unset or invalid.
+func getEnvInt(key string, def int64) int64 {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		log.Warnf("Invalid %s: %q, using %d", key, v, def)
+		return def
+	}
+	return n
+}
+
+// timeout bounds a route with http.TimeoutHandler, which answers 503 once
+// the deadline passes. The handler runs on its own echo.Context so that a
+// handler outliving the deadline never touches the pooled one; headers set
+// by earlier middleware such as CORS and X-Request-Id still go out with the
+// 503. TimeoutHandler buffers the whole response, so it is only meant for
+// routes with small bodies, not for serving images.
+func timeout(d time.Duration) echo.MiddlewareFunc {
+	const msg = `{"message":"Request timed out"}`
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			e := c.Echo()
+			routePath := c.Path()
+			names := append([]string(nil), c.ParamNames()...)
+			values := append([]string(nil), c.ParamValues()...)
+
+			h := http.TimeoutHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				tc := e.NewContext(r, w)
+				tc.SetPath(routePath)
+				tc.SetParamNames(names...)
+				tc.SetParamValues(values...)
+				if err := next(tc); err != nil {
+					e.HTTPErrorHandler(err, tc)
+				}
+			}), d, msg)
+			h.ServeHTTP(closeOnTimeoutWriter{c.Response()}, c.Request())
+			return nil
+		}
+	}
+}
+
+// closeOnTimeoutWriter closes the connection after a 503. Otherwise net/http
+// drains the rest of a slow request body before sending the timeout response.
+// It also labels the plain timeout message as JSON.
+type closeOnTimeoutWriter struct {
+	http.ResponseWriter
+}
+
+func (w closeOnTimeoutWriter) WriteHeader(code int) {
+	if code == http.StatusServiceUnavailable {
+		w.Header().Set(echo.HeaderConnection, "close")
+		if w.Header().Get(echo.HeaderContentType) == "" {
+			w.Header().Set(echo.HeaderContentType, echo.MIMEApplicationJSONCharsetUTF8)
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// logPanic logs a recovered panic with its stack and request id, and returns
+// a plain 500 so the client gets the usual JSON message without the stack.
+func logPanic(c echo.Context, err error, stack []byte) error {
+	id := c.Response().Header().Get(echo.HeaderXRequestID)
+	c.Logger().Errorf("[PANIC RECOVER] request_id=%s %v\n%s", id, err, stack)
+	return echo.NewHTTPError(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+}
+
+// responseTime reports the handler duration in the X-Response-Time header.
+// The header is set just before the response is written.
+func responseTime(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		start := time.Now()
+		c.Response().Before(func() {
+			c.Response().Header().Set("X-Response-Time", time.Since(start).String())
+		})
+		return next(c)
+	}
+}
+
+// uniqueFormFields rejects requests that repeat a form field with 400,
+// since c.FormValue would otherwise silently pick one of the values.
+// URL query values are merged into the form, so a field given in both
+// the query string and the body is a duplicate as well.
+// Use it on every handler that mutates data from form input.
+func uniqueFormFields(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		params, err := c.FormParams()
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid form data")
+		}
+		var dups []string
+		for key, values := range params {
+			if len(values) > 1 {
+				dups = append(dups, key)
+			}
+		}
+		if len(dups) > 0 {
+			sort.Strings(dups)
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Duplicate form fields: %s", strings.Join(dups, ", ")))
+		}
+		return next(c)
+	}
+}
+
+// allowQuery rejects query parameters other than keys with 400,
+// listing the unexpected ones so typos surface early.
+func allowQuery(keys ...string) echo.MiddlewareFunc {
+	allowed := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		allowed[key] = true
+	}
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			var unexpected []string
+			for key := range c.QueryParams() {
+				if !allowed[key] {
+					unexpected = append(unexpected, key)
+				}
+			}
+			if len(unexpected) > 0 {
+				sort.Strings(unexpected)
+				return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Unexpected query parameters: %s", strings.Join(unexpected, ", ")))
+			}
+			return next(c)
+		}
+	}
+}
+
+// skipPaths returns a Skipper matching request paths against
+// comma-separated path.Match patterns such as "/image/*".
+func skipPaths(patterns string) middleware.Skipper {
+	var list []string
+	for _, p := range strings.Split(patterns, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			list = append(list, p)
+		}
+	}
+	return func(c echo.Context) bool {
+		for _, p := range list {
+			if ok, _ := path.Match(p, c.Request().URL.Path); ok {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// newServer sets up the middleware and routes of the API.
+// checks are the startup self-check results reported by /healthz.
+func newServer(cfg Config, checks []Check) *echo.Echo {
+	e := echo.New()
+
+	// Middleware
+	e.Use(middleware.RequestID())
+	e.Use(middleware.LoggerWithConfig(middleware.LoggerConfig{
+		Skipper: skipPaths(cfg.LogSkipPaths),
+	}))
+	e.Use(middleware.RecoverWithConfig(middleware.RecoverConfig{
+		LogErrorFunc: logPanic,
+	}))
+	e.Use(responseTime)
+	if lvl, ok := LogLevels[cfg.LogLevel]; ok {
+		e.Logger.SetLevel(lvl)
+	}
+
 	e.Use(middleware.CORSWithConfig(middleware.CORSConfig{
-		AllowOrigins: []string{front_url},
-		AllowMethods: []string{http.MethodGet, http.MethodPut, http.MethodPost, http.MethodDelete},
+		AllowOrigins:  cfg.CORSOrigins,
+		AllowMethods:  []string{http.MethodGet, http.MethodPut, http.MethodPost, http.MethodDelete},
+		ExposeHeaders: []string{echo.HeaderXRequestID, "X-Response-Time"},
 	}))
 
+	// Unknown query parameters are only rejected when STRICT_QUERY_PARAMS=true
+	query := func(keys ...string) echo.MiddlewareFunc {
+		if !cfg.StrictQueryParams {
+			return func(next echo.HandlerFunc) echo.HandlerFunc { return next }
+		}
+		return allowQuery(keys...)
+	}
+
+	// Timeouts: reads should stay snappy, uploads may take longer.
+	// Images are streamed from disk and left without a timeout.
+	readTimeout := timeout(cfg.ReadTimeout)
+	uploadTimeout := timeout(cfg.UploadTimeout)
+
 	// Routes
-	e.GET("/", root)
-	e.POST("/items", addItem)
-	e.GET("/image/:imageFilename", getImg)
+	e.GET("/", root, readTimeout, query())
+	e.GET("/healthz", healthz(cfg.ImgDir, checks), readTimeout, query())
+	e.GET("/limits", getLimits(cfg), readTimeout, query())
+	// Mutating routes reject a form field sent more than once with 400,
+	// counting the query string too, rather than picking one value.
+	e.POST("/items", addItem, uploadTimeout, query(), uploadLimit(cfg), uniqueFormFields)
+	e.POST("/images/validate", validateImage(cfg), uploadTimeout, query(), uploadLimit(cfg))
+	e.POST("/images/metadata", getImgMetadata(cfg.ImgDir), readTimeout, query(), imgMetadataLimit())
+	e.GET("/image/:imageFilename", getImg(cfg.ImgDir, newImgCache(cfg.ImgCacheBytes), cfg.ImgFallback), query())
+
+	// Admin routes are only served when ADMIN_TOKEN is set
+	if token := os.Getenv("ADMIN_TOKEN"); token != "" {
+		admin := e.Group("/admin", adminAuth(token))
+		admin.GET("/config", showConfig(cfg), readTimeout, query())
+	}
 
+	return e
+}
+
+func main() {
+	cfg := loadConfig()
+	if err := cfg.Validate(); err != nil {
+		log.Fatalf("Invalid configuration: %s", err)
+	}
+	checks := selfCheck(cfg.ImgDir)
+	e := newServer(cfg, checks)
+
+	// Refuse to start on a misconfigured environment
+	failed := false
+	for _, check := range checks {
+		if !check.OK {
+			e.Logger.Errorf("Self-check %s failed: %s", check.Name, check.Error)
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
 
 	// Start server
-	e.Logger.Fatal(e.Start(":9000"))
+	e.Logger.Fatal(e.Start(cfg.Addr))
 }
@@ -0,0 +1,486 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+func testConfig() Config {
+	return loadConfig()
+}
+
+// encodeImg returns a blank w x h image encoded as "jpeg" or "png".
+func encodeImg(t *testing.T, format string, w, h int) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	var buf bytes.Buffer
+	var err error
+	switch format {
+	case "jpeg":
+		err = jpeg.Encode(&buf, img, nil)
+	case "png":
+		err = png.Encode(&buf, img)
+	default:
+		t.Fatalf("unknown image format %q", format)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestTimeout(t *testing.T) {
+	cfg := testConfig()
+	e := newServer(cfg, nil)
+	e.GET("/slow", func(c echo.Context) error {
+		select {
+		case <-time.After(2 * time.Second):
+		case <-c.Request().Context().Done():
+		}
+		return c.NoContent(http.StatusOK)
+	}, timeout(100*time.Millisecond))
+
+	start := time.Now()
+	req := httptest.NewRequest(http.MethodGet, "/slow", nil)
+	req.Header.Set(echo.HeaderOrigin, cfg.CORSOrigins[0])
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+	if got, want := rec.Body.String(), `{"message":"Request timed out"}`; got != want {
+		t.Errorf("body = %s, want %s", got, want)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("request took %s, want it cut off after 100ms", elapsed)
+	}
+	if got := rec.Header().Get(echo.HeaderAccessControlAllowOrigin); got != cfg.CORSOrigins[0] {
+		t.Errorf("%s = %q, want %q", echo.HeaderAccessControlAllowOrigin, got, cfg.CORSOrigins[0])
+	}
+	if rec.Header().Get(echo.HeaderXRequestID) == "" {
+		t.Errorf("missing %s header", echo.HeaderXRequestID)
+	}
+}
+
+func TestTimeoutKeepsRoute(t *testing.T) {
+	e := newServer(testConfig(), nil)
+	e.GET("/echo/:id", func(c echo.Context) error {
+		return c.String(http.StatusOK, c.Path()+" "+c.Param("id"))
+	}, timeout(time.Second))
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/echo/42", nil))
+	if got, want := rec.Body.String(), "/echo/:id 42"; got != want {
+		t.Errorf("body = %q, want %q", got, want)
+	}
+}
+
+func TestUploadTimeoutSlowBody(t *testing.T) {
+	cfg := testConfig()
+	cfg.UploadTimeout = 100 * time.Millisecond
+	srv := httptest.NewServer(newServer(cfg, nil))
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Announce a larger body than is sent so the handler keeps waiting
+	start := time.Now()
+	fmt.Fprintf(conn, "POST /items HTTP/1.1\r\nHost: test\r\nContent-Type: %s\r\nContent-Length: 100\r\n\r\nname=jacket", echo.MIMEApplicationForm)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want %d", res.StatusCode, http.StatusServiceUnavailable)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("request took %s, want it cut off after 100ms", elapsed)
+	}
+}
+
+// doForm sends a form request through the full server.
+func doForm(t *testing.T, e *echo.Echo, target, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, target, strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestAddItemDuplicateFields(t *testing.T) {
+	e := newServer(testConfig(), nil)
+
+	cases := []struct {
+		name   string
+		target string
+		body   string
+	}{
+		{"body", "/items", "name=a&name=b"},
+		{"query and body", "/items?name=a", "name=b"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := doForm(t, e, tc.target, tc.body)
+			if rec.Code != http.StatusBadRequest {
+				t.Errorf("status = %d, want %d", rec.Code, http.StatusBadRequest)
+			}
+			if got, want := strings.TrimSpace(rec.Body.String()), `{"message":"Duplicate form fields: name"}`; got != want {
+				t.Errorf("body = %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+func TestAddItemBind(t *testing.T) {
+	e := newServer(testConfig(), nil)
+
+	cases := []struct {
+		name        string
+		contentType string
+		body        string
+		wantCode    int
+		wantBody    string
+	}{
+		{"form", echo.MIMEApplicationForm, "name=jacket", http.StatusOK, `{"message":"item received: jacket"}`},
+		{"json", echo.MIMEApplicationJSON, `{"name":"jacket"}`, http.StatusOK, `{"message":"item received: jacket"}`},
+		{"no content type", "", "name=jacket", http.StatusUnsupportedMediaType, `{"message":"Unsupported Media Type"}`},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/items", strings.NewReader(tc.body))
+			if tc.contentType != "" {
+				req.Header.Set(echo.HeaderContentType, tc.contentType)
+			}
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+
+			if rec.Code != tc.wantCode {
+				t.Errorf("status = %d, want %d", rec.Code, tc.wantCode)
+			}
+			if got := strings.TrimSpace(rec.Body.String()); got != tc.wantBody {
+				t.Errorf("body = %s, want %s", got, tc.wantBody)
+			}
+		})
+	}
+}
+
+func TestPanicRecovery(t *testing.T) {
+	e := newServer(testConfig(), nil)
+	e.GET("/panic", func(c echo.Context) error {
+		panic("boom")
+	})
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/panic", nil))
+
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusInternalServerError)
+	}
+	body := strings.TrimSpace(rec.Body.String())
+	if want := `{"message":"Internal Server Error"}`; body != want {
+		t.Errorf("body = %s, want %s", body, want)
+	}
+	if strings.Contains(body, "goroutine") || strings.Contains(body, "boom") {
+		t.Errorf("body leaks the panic: %s", body)
+	}
+	if rec.Header().Get(echo.HeaderXRequestID) == "" {
+		t.Errorf("missing %s header", echo.HeaderXRequestID)
+	}
+}
+
+func TestAddItemNormalizesName(t *testing.T) {
+	e := newServer(testConfig(), nil)
+
+	// "e" followed by a combining acute accent is stored as the composed "é"
+	rec := doForm(t, e, "/items", url.Values{"name": {"e\u0301"}}.Encode())
+
+	var res Response
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if want := "item received: \u00e9"; res.Message != want {
+		t.Errorf("message = %q, want %q", res.Message, want)
+	}
+}
+
+func TestAdminAuth(t *testing.T) {
+	const token = "s3cret"
+	t.Setenv("ADMIN_TOKEN", token)
+	e := newServer(testConfig(), nil)
+
+	cases := []struct {
+		name     string
+		auth     string
+		wantCode int
+	}{
+		{"missing token", "", http.StatusBadRequest},
+		{"wrong token", "Bearer nope", http.StatusUnauthorized},
+		{"correct token", "Bearer " + token, http.StatusOK},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/admin/config", nil)
+			if tc.auth != "" {
+				req.Header.Set(echo.HeaderAuthorization, tc.auth)
+			}
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+
+			if rec.Code != tc.wantCode {
+				t.Errorf("status = %d, want %d", rec.Code, tc.wantCode)
+			}
+			if strings.Contains(rec.Body.String(), token) {
+				t.Errorf("body leaks the admin token: %s", rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestAdminRoutesDisabledWithoutToken(t *testing.T) {
+	t.Setenv("ADMIN_TOKEN", "")
+	e := newServer(testConfig(), nil)
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/admin/config", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	t.Setenv("ADDR", ":8080")
+	t.Setenv("IMG_DIR", "/srv/images")
+	t.Setenv("LOG_LEVEL", "debug")
+
+	cfg := loadConfig()
+	if cfg.Addr != ":8080" || cfg.ImgDir != "/srv/images" || cfg.LogLevel != "DEBUG" {
+		t.Errorf("loadConfig() = %+v, want addr, img dir and log level from the environment", cfg)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("Validate() = %v, want nil", err)
+	}
+
+	cfg.LogLevel = "LOUD"
+	if err := cfg.Validate(); err == nil {
+		t.Error("Validate() = nil, want an error for an unknown log level")
+	}
+}
+
+func TestHealthz(t *testing.T) {
+	passed := []Check{{Name: "img_dir_writable", OK: true}}
+	failed := []Check{{Name: "img_dir_writable", Error: "read-only file system"}}
+
+	cases := []struct {
+		name       string
+		checks     []Check
+		defaultImg bool
+		wantCode   int
+		wantStatus string
+	}{
+		{"healthy", passed, true, http.StatusOK, "ok"},
+		{"failed startup check", failed, true, http.StatusServiceUnavailable, "unhealthy"},
+		{"default image removed", passed, false, http.StatusServiceUnavailable, "unhealthy"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.ImgDir = t.TempDir()
+			if tc.defaultImg {
+				if err := os.WriteFile(path.Join(cfg.ImgDir, DefaultImg), []byte("jpeg"), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			e := newServer(cfg, tc.checks)
+
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+
+			if rec.Code != tc.wantCode {
+				t.Errorf("status = %d, want %d", rec.Code, tc.wantCode)
+			}
+			var res Health
+			if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+				t.Fatal(err)
+			}
+			if res.Status != tc.wantStatus {
+				t.Errorf("health status = %q, want %q", res.Status, tc.wantStatus)
+			}
+			if len(res.Checks) != 3 {
+				t.Errorf("checks = %+v, want the startup check and two probes", res.Checks)
+			}
+		})
+	}
+}
+
+func TestStrictQueryParams(t *testing.T) {
+	cases := []struct {
+		name     string
+		strict   bool
+		wantCode int
+		wantBody string
+	}{
+		{"strict", true, http.StatusBadRequest, `{"message":"Unexpected query parameters: a, b"}`},
+		{"lenient", false, http.StatusOK, `{"message":"Hello, world!"}`},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.StrictQueryParams = tc.strict
+			e := newServer(cfg, nil)
+
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/?b=1&a=2", nil))
+
+			if rec.Code != tc.wantCode {
+				t.Errorf("status = %d, want %d", rec.Code, tc.wantCode)
+			}
+			if got := strings.TrimSpace(rec.Body.String()); got != tc.wantBody {
+				t.Errorf("body = %s, want %s", got, tc.wantBody)
+			}
+		})
+	}
+}
+
+func TestSkipPaths(t *testing.T) {
+	skip := skipPaths(" /healthz, ,/image/*,")
+	e := echo.New()
+
+	cases := []struct {
+		path string
+		want bool
+	}{
+		{"/healthz", true},
+		{"/image/default.jpg", true},
+		{"/image", false},
+		{"/image/a/b.jpg", false},
+		{"/", false},
+		{"/items", false},
+	}
+	for _, tc := range cases {
+		c := e.NewContext(httptest.NewRequest(http.MethodGet, tc.path, nil), httptest.NewRecorder())
+		if got := skip(c); got != tc.want {
+			t.Errorf("skip(%s) = %v, want %v", tc.path, got, tc.want)
+		}
+	}
+}
+
+func TestGetImg(t *testing.T) {
+	imgDir := t.TempDir()
+	defaultJPEG := encodeImg(t, "jpeg", 2, 2)
+	abcPNG := encodeImg(t, "png", 3, 3)
+	if err := os.WriteFile(path.Join(imgDir, DefaultImg), defaultJPEG, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path.Join(imgDir, "abc.png"), abcPNG, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name            string
+		filename        string
+		fallback        bool
+		wantCode        int
+		wantContentType string
+		wantBody        []byte
+	}{
+		{"unsupported extension", "x.gif", true, http.StatusNotFound, echo.MIMEApplicationJSONCharsetUTF8, []byte(`{"message":"Image not found"}`)},
+		{"missing without fallback", "missing.jpg", false, http.StatusNotFound, echo.MIMEApplicationJSONCharsetUTF8, []byte(`{"message":"Image not found"}`)},
+		{"missing with fallback", "missing.jpg", true, http.StatusOK, "image/jpeg", defaultJPEG},
+		{"other extension", "abc.jpg", false, http.StatusOK, "image/png", abcPNG},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.ImgDir = imgDir
+			cfg.ImgFallback = tc.fallback
+			e := newServer(cfg, nil)
+
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/image/"+tc.filename, nil))
+
+			if rec.Code != tc.wantCode {
+				t.Errorf("status = %d, want %d", rec.Code, tc.wantCode)
+			}
+			if got := rec.Header().Get(echo.HeaderContentType); got != tc.wantContentType {
+				t.Errorf("Content-Type = %q, want %q", got, tc.wantContentType)
+			}
+			if got := bytes.TrimSpace(rec.Body.Bytes()); !bytes.Equal(got, tc.wantBody) {
+				t.Errorf("body = %q, want %q", got, tc.wantBody)
+			}
+		})
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	cases := []struct {
+		name   string
+		modify func(*Config)
+		ok     bool
+	}{
+		{"defaults", func(cfg *Config) {}, true},
+		{"zero upload size", func(cfg *Config) { cfg.MaxUploadBytes = 0 }, false},
+		{"min above max", func(cfg *Config) { cfg.ImgMinDim, cfg.ImgMaxDim = 200, 100 }, false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := testConfig()
+			tc.modify(&cfg)
+			if err := cfg.Validate(); (err == nil) != tc.ok {
+				t.Errorf("Validate() = %v, want ok=%v", err, tc.ok)
+			}
+		})
+	}
+}
+
+func TestGetLimits(t *testing.T) {
+	cfg := testConfig()
+	cfg.MaxUploadBytes = 1000
+	cfg.ImgMinDim, cfg.ImgMaxDim = 2, 300
+	e := newServer(cfg, nil)
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/limits", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	want := `{"max_upload_bytes":1000,"img_content_types":["image/jpeg","image/png"],"img_exts":[".jpg",".jpeg",".png"],"img_min_dim":2,"img_max_dim":300,"max_img_metadata_batch":100}`
+	if got := strings.TrimSpace(rec.Body.String()); got != want {
+		t.Errorf("body = %s, want %s", got, want)
+	}
+}
+
+func TestAddItemBodyLimit(t *testing.T) {
+	cfg := testConfig()
+	cfg.MaxUploadBytes = 1000
+
+	rec := doForm(t, newServer(cfg, nil), "/items", "name="+strings.Repeat("a", 2*MultipartOverhead))
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusRequestEntityTooLarge)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// ImgContentTypes are the content types accepted for image uploads.
+var ImgContentTypes = []string{"image/jpeg", "image/png"}
+
+func isImgContentType(contentType string) bool {
+	for _, t := range ImgContentTypes {
+		if t == contentType {
+			return true
+		}
+	}
+	return false
+}
+
+type ImageInfo struct {
+	Valid       bool   `json:"valid"`
+	Hash        string `json:"hash"`
+	ContentType string `json:"content_type"`
+	Width       int    `json:"width"`
+	Height      int    `json:"height"`
+	Size        int64  `json:"size"`
+}
+
+// MultipartOverhead is the room left for multipart headers and other form
+// fields on top of MaxUploadBytes when limiting upload request bodies.
+const MultipartOverhead = 64 << 10
+
+func imageError(format string, a ...interface{}) error {
+	return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf(format, a...))
+}
+
+// checkImage reads an uploaded image and validates its size, content type
+// and dimensions against cfg. Every image upload should go through it.
+// Failures are returned as 400 HTTPErrors.
+func checkImage(r io.Reader, cfg Config) (*ImageInfo, error) {
+	data, err := io.ReadAll(io.LimitReader(r, cfg.MaxUploadBytes+1))
+	if err != nil {
+		return nil, imageError("Failed to read image")
+	}
+	if len(data) == 0 {
+		return nil, imageError("Image is empty")
+	}
+	if int64(len(data)) > cfg.MaxUploadBytes {
+		return nil, imageError("Image is larger than %d bytes", cfg.MaxUploadBytes)
+	}
+
+	contentType := http.DetectContentType(data)
+	if !isImgContentType(contentType) {
+		return nil, imageError("Unsupported image type: %s", contentType)
+	}
+
+	conf, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, imageError("Failed to decode image")
+	}
+	if conf.Width < cfg.ImgMinDim || conf.Height < cfg.ImgMinDim {
+		return nil, imageError("Image is smaller than %dx%d", cfg.ImgMinDim, cfg.ImgMinDim)
+	}
+	if conf.Width > cfg.ImgMaxDim || conf.Height > cfg.ImgMaxDim {
+		return nil, imageError("Image is larger than %dx%d", cfg.ImgMaxDim, cfg.ImgMaxDim)
+	}
+
+	sum := sha256.Sum256(data)
+	info := &ImageInfo{
+		Valid:       true,
+		Hash:        hex.EncodeToString(sum[:]),
+		ContentType: contentType,
+		Width:       conf.Width,
+		Height:      conf.Height,
+		Size:        int64(len(data)),
+	}
+	return info, nil
+}
+
+// uploadLimit bounds the request body of upload routes so the multipart
+// form is never parsed beyond MaxUploadBytes.
+func uploadLimit(cfg Config) echo.MiddlewareFunc {
+	return middleware.BodyLimit(strconv.FormatInt(cfg.MaxUploadBytes+MultipartOverhead, 10))
+}
+
+// validateImage runs the upload checks on the "image" form file without
+// storing anything.
+func validateImage(cfg Config) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		file, err := c.FormFile("image")
+		if err != nil {
+			// The body limit surfaces as an error while parsing the form
+			var he *echo.HTTPError
+			if errors.As(err, &he) {
+				return he
+			}
+			return imageError("Missing image file")
+		}
+		if file.Size > cfg.MaxUploadBytes {
+			return imageError("Image is larger than %d bytes", cfg.MaxUploadBytes)
+		}
+		src, err := file.Open()
+		if err != nil {
+			return imageError("Failed to open image file")
+		}
+		defer src.Close()
+
+		info, err := checkImage(src, cfg)
+		if err != nil {
+			return err
+		}
+		return c.JSON(http.StatusOK, info)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func postImage(t *testing.T, cfg Config, data []byte) *httptest.ResponseRecorder {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, err := mw.CreateFormFile("image", "image.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write(data)
+	mw.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/images/validate", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	rec := httptest.NewRecorder()
+	newServer(cfg, nil).ServeHTTP(rec, req)
+	return rec
+}
+
+func TestValidateImageBodyLimit(t *testing.T) {
+	cfg := testConfig()
+	cfg.MaxUploadBytes = 1000
+
+	rec := postImage(t, cfg, make([]byte, 2*MultipartOverhead))
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusRequestEntityTooLarge)
+	}
+}
+
+func TestValidateImageEmpty(t *testing.T) {
+	rec := postImage(t, testConfig(), nil)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+	if got, want := strings.TrimSpace(rec.Body.String()), `{"message":"Image is empty"}`; got != want {
+		t.Errorf("body = %s, want %s", got, want)
+	}
+}
+
+func TestValidateImage(t *testing.T) {
+	for _, format := range []string{"jpeg", "png"} {
+		t.Run(format, func(t *testing.T) {
+			data := encodeImg(t, format, 4, 3)
+			rec := postImage(t, testConfig(), data)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusOK, rec.Body.String())
+			}
+
+			sum := sha256.Sum256(data)
+			want := ImageInfo{
+				Valid:       true,
+				Hash:        hex.EncodeToString(sum[:]),
+				ContentType: "image/" + format,
+				Width:       4,
+				Height:      3,
+				Size:        int64(len(data)),
+			}
+			wantBody, err := json.Marshal(want)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.TrimSpace(rec.Body.String()); got != string(wantBody) {
+				t.Errorf("body = %s, want %s", got, wantBody)
+			}
+		})
+	}
+}
+
+func TestValidateImageRejected(t *testing.T) {
+	cfg := testConfig()
+	cfg.ImgMinDim, cfg.ImgMaxDim = 4, 8
+
+	cases := []struct {
+		name     string
+		data     []byte
+		wantBody string
+	}{
+		{"unsupported type", []byte("GIF89a not really"), `{"message":"Unsupported image type: image/gif"}`},
+		{"too small", encodeImg(t, "png", 3, 10), `{"message":"Image is smaller than 4x4"}`},
+		{"too large", encodeImg(t, "jpeg", 9, 5), `{"message":"Image is larger than 8x8"}`},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := postImage(t, cfg, tc.data)
+			if rec.Code != http.StatusBadRequest {
+				t.Errorf("status = %d, want %d", rec.Code, http.StatusBadRequest)
+			}
+			if got := strings.TrimSpace(rec.Body.String()); got != tc.wantBody {
+				t.Errorf("body = %s, want %s", got, tc.wantBody)
+			}
+		})
+	}
+}